@@ -29,6 +29,14 @@ const (
 	loadBalanceLatency
 )
 
+// ListNormalize selects transforms applied to sites in user lists.
+type ListNormalize byte
+
+const (
+	listNormalizeWWW    ListNormalize = 1 << iota // strip leading "www."
+	listNormalizeDomain                           // use domain instead of host
+)
+
 // allow the same tunnel ports as polipo
 var defaultTunnelAllowedPort = []string{
 	"22", "80", "443", // ssh, http, https
@@ -59,6 +67,8 @@ type Config struct {
 	DialTimeout time.Duration
 	ReadTimeout time.Duration
 
+	TempBlockedTimeout time.Duration // how long to use parent proxy after blocked
+
 	Core         int
 	DetectSSLErr bool
 
@@ -69,8 +79,13 @@ type Config struct {
 	BlockedFile string // blocked sites specified by user
 	DirectFile  string // direct sites specified by user
 
+	// Whether direct file wins if a site is in both blocked and direct file
+	DirectOnConflict bool
+	ListNormalize    ListNormalize
+
 	// not configurable in config file
 	PrintVer        bool
+	CheckLists      bool   // Check site lists and exit.
 	EstimateTimeout bool   // Whether to run estimateTimeout().
 	EstimateTarget  string // Timeout estimate target site.
 
@@ -97,6 +112,7 @@ func initConfig(rcFile string) {
 	config.AuthTimeout = 2 * time.Hour
 	config.DialTimeout = defaultDialTimeout
 	config.ReadTimeout = defaultReadTimeout
+	config.TempBlockedTimeout = defaultTmpBlockedTimeout
 
 	config.TunnelAllowedPort = make(map[string]bool)
 	for _, port := range defaultTunnelAllowedPort {
@@ -119,6 +135,7 @@ func parseCmdLineConfig() *Config {
 	flag.IntVar(&c.Core, "core", 2, "number of cores to use")
 	flag.StringVar(&c.LogFile, "logFile", "", "write output to file")
 	flag.BoolVar(&c.PrintVer, "version", false, "print version")
+	flag.BoolVar(&c.CheckLists, "checklists", false, "check blocked/direct site lists and exit")
 	flag.BoolVar(&c.EstimateTimeout, "estimate", true, "enable/disable estimate timeout")
 
 	flag.Parse()
@@ -475,6 +492,32 @@ func (p configParser) ParseDirectFile(val string) {
 	}
 }
 
+func (p configParser) ParseListConflict(val string) {
+	switch val {
+	case "blocked":
+		config.DirectOnConflict = false
+	case "direct":
+		config.DirectOnConflict = true
+	default:
+		Fatalf("invalid listConflict: %s, should be blocked or direct\n", val)
+	}
+}
+
+func (p configParser) ParseListNormalize(val string) {
+	config.ListNormalize = 0
+	for _, s := range strings.Split(val, ",") {
+		switch strings.TrimSpace(s) {
+		case "www":
+			config.ListNormalize |= listNormalizeWWW
+		case "domain":
+			config.ListNormalize |= listNormalizeDomain
+		case "none":
+		default:
+			Fatalf("invalid listNormalize: %s, should be www, domain or none\n", s)
+		}
+	}
+}
+
 var shadow struct {
 	parent *shadowsocksParent
 	passwd string
@@ -583,6 +626,13 @@ func (p configParser) ParseDialTimeout(val string) {
 	config.DialTimeout = parseDuration(val, "dialTimeout")
 }
 
+func (p configParser) ParseTempBlockedTimeout(val string) {
+	config.TempBlockedTimeout = parseDuration(val, "tempBlockedTimeout")
+	if config.TempBlockedTimeout <= 0 {
+		Fatal("tempBlockedTimeout should be positive")
+	}
+}
+
 func (p configParser) ParseDetectSSLErr(val string) {
 	config.DetectSSLErr = parseBool(val, "detectSSLErr")
 }
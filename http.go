@@ -240,6 +240,9 @@ func (url *URL) ParseHostPort(hostPort string) {
 	if hostPort == "" {
 		return
 	}
+	// Host name is case insensitive, use lower case so site stat and user
+	// specified sites will always match.
+	hostPort = strings.ToLower(hostPort)
 	host, port, err := net.SplitHostPort(hostPort)
 	if err != nil {
 		// Add default 80 and split again. If there's still error this time,
@@ -291,6 +294,7 @@ func ParseRequestURIBytes(rawurl []byte) (*URL, error) {
 		hostport = string(rest[:id])
 		path = string(rest[id:])
 	}
+	hostport = strings.ToLower(hostport)
 
 	// Must add port in host so it can be used as key to find the correct
 	// server connection.
@@ -28,6 +28,7 @@ func TestParseRequestURI(t *testing.T) {
 		{"simplehost", &URL{"simplehost:80", "simplehost", "80", "", ""}},
 		{"simplehost:8080", &URL{"simplehost:8080", "simplehost", "8080", "", ""}},
 		{"192.168.1.1:8080/", &URL{"192.168.1.1:8080", "192.168.1.1", "8080", "", "/"}},
+		{"http://WWW.G.com/NCR", &URL{"www.g.com:80", "www.g.com", "80", "g.com", "/NCR"}},
 		{"/helloworld", &URL{"", "", "", "", "/helloworld"}},
 	}
 	for _, td := range testData {
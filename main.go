@@ -39,6 +39,13 @@ func main() {
 
 	parseConfig(cmdLineConfig.RcFile, cmdLineConfig)
 
+	if cmdLineConfig.CheckLists {
+		if checkSiteLists() != 0 {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	initSelfListenAddr()
 	initLog()
 	initAuth()
@@ -116,6 +116,8 @@ function host2Domain(host) {
 function FindProxyForURL(url, host) {
 	if (url.substring(0,4) == "ftp:")
 		return direct;
+	if (host.charAt(host.length-1) == ".") // fully qualified host
+		host = host.substring(0, host.length-1);
 	if (host.substring(0,7) == "::ffff:")
 		return direct;
 	if (host.indexOf(".local", host.length - 6) !== -1) {
@@ -86,6 +86,8 @@ function host2Domain(host) {
 function FindProxyForURL(url, host) {
 	if (url.substring(0,4) == "ftp:")
 		return direct;
+	if (host.charAt(host.length-1) == ".") // fully qualified host
+		host = host.substring(0, host.length-1);
 	if (host.indexOf(".local", host.length - 6) !== -1) {
 		return direct;
 	}
@@ -157,6 +159,7 @@ testData = [
 	{ host: 'taobao.com', mode: direct},
 	{ host: 'www.taobao.com', mode: direct},
 	{ host: 'www.baidu.com', mode: direct},
+	{ host: 'www.taobao.com.', mode: direct},
 
 	// host not in direct domain should return proxy
 	{ host: 'baidu.com', mode: httpProxy},
@@ -1,12 +1,16 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math/rand"
 	"os"
+	"path"
 	"strings"
 	"sync"
 	"time"
@@ -86,7 +90,10 @@ func (vc *VisitCnt) shouldNotSave() bool {
 	return vc.userSpecified() || vc.isStale() || (vc.Blocked == 0 && vc.Direct == 0)
 }
 
-const tmpBlockedTimeout = 2 * time.Minute
+const defaultTmpBlockedTimeout = 2 * time.Minute
+
+// Set by initSiteStat according to config.
+var tmpBlockedTimeout = defaultTmpBlockedTimeout
 
 func (vc *VisitCnt) AsTempBlocked() bool {
 	return time.Now().Sub(vc.blockedOn) < tmpBlockedTimeout
@@ -208,7 +215,7 @@ func (ss *SiteStat) create(s string) (vcnt *VisitCnt) {
 func (ss *SiteStat) TempBlocked(url *URL) {
 	debug.Printf("%s temp blocked\n", url.Host)
 
-	vcnt := ss.get(url.Host)
+	vcnt := ss.get(trimLastDot(url.Host))
 	if vcnt == nil {
 		panic("TempBlocked should always get existing visitCnt")
 	}
@@ -239,17 +246,62 @@ func (ss *SiteStat) GetVisitCnt(url *URL) (vcnt *VisitCnt) {
 	if url.Domain == "" { // simple host or private ip
 		return alwaysDirectVisitCnt
 	}
-	if vcnt = ss.get(url.Host); vcnt != nil {
+	if vcnt = ss.lookup(url); vcnt != nil {
 		return
 	}
-	if len(url.Domain) != len(url.Host) {
-		if dmcnt := ss.get(url.Domain); dmcnt != nil && dmcnt.userSpecified() {
+	return ss.create(trimLastDot(url.Host))
+}
+
+// lookup finds VisitCnt for url's host, or for its parent domain if specified
+// by user. Takes the read lock only once for all the keys.
+func (ss *SiteStat) lookup(url *URL) *VisitCnt {
+	// Fully qualified host like "example.com." is the same as "example.com".
+	host := trimLastDot(url.Host)
+	ss.vcLock.RLock()
+	defer ss.vcLock.RUnlock()
+	if vcnt, ok := ss.Vcnt[host]; ok {
+		return vcnt
+	}
+	// Check parent domains of host, from the longest one to the domain. So
+	// user specified plus.google.com will also cover www.plus.google.com.
+	parents := []string{url.Domain}
+	if len(host) > maxHostLen {
+		debug.Printf("host %s... too long (%d bytes), only domain checked\n",
+			host[:32], len(host))
+	} else {
+		parents = hostSuffixes(host, url.Domain)
+	}
+	for _, sfx := range parents {
+		if dmcnt, ok := ss.Vcnt[sfx]; ok && dmcnt.userSpecified() {
 			// if the domain is not specified by user, should create a new host
 			// visitCnt
 			return dmcnt
 		}
 	}
-	return ss.create(url.Host)
+	return nil
+}
+
+// Longest host name allowed by DNS. Longer host can't be resolved, so don't
+// bother walking its intermediate parent domains.
+const maxHostLen = 253
+
+// hostSuffixes returns parent domains of host down to domain, longest first.
+// host itself is not included. Domain is where to stop, so public suffixes
+// like com.hk will never be returned.
+func hostSuffixes(host, domain string) (sfx []string) {
+	host = trimLastDot(host)
+	if len(host) <= len(domain) || !strings.HasSuffix(host, domain) {
+		return
+	}
+	for s := host; len(s) > len(domain); {
+		id := strings.IndexByte(s, '.')
+		if id == -1 {
+			break
+		}
+		s = s[id+1:]
+		sfx = append(sfx, s)
+	}
+	return
 }
 
 func (ss *SiteStat) store(statPath string) (err error) {
@@ -260,12 +312,19 @@ func (ss *SiteStat) store(statPath string) (err error) {
 	}
 	if now.Sub(time.Time(ss.Update)) > siteStaleThreshold {
 		// Not updated for a long time, don't drop any record
-		savedSS = ss
 		// Changing update time too fast will also drop useful record
-		savedSS.Update = Date(time.Time(ss.Update).Add(siteStaleThreshold / 2))
-		if time.Time(savedSS.Update).After(now) {
-			savedSS.Update = Date(now)
+		ss.Update = Date(time.Time(ss.Update).Add(siteStaleThreshold / 2))
+		if time.Time(ss.Update).After(now) {
+			ss.Update = Date(now)
+		}
+		// Copy records as Vcnt may be updated while marshalling.
+		savedSS = newSiteStat()
+		savedSS.Update = ss.Update
+		ss.vcLock.RLock()
+		for site, vcnt := range ss.Vcnt {
+			savedSS.Vcnt[site] = vcnt
 		}
+		ss.vcLock.RUnlock()
 	} else {
 		savedSS = newSiteStat()
 		savedSS.Update = Date(now)
@@ -284,6 +343,14 @@ func (ss *SiteStat) store(statPath string) (err error) {
 		errl.Println("Error marshalling site stat:", err)
 		panic("internal error: error marshalling site")
 	}
+	// End the file with newline like other text files.
+	b = append(b, '\n')
+
+	// Visit count and dates may not change for a long time, e.g. when the
+	// computer is idle. Avoid rewriting the same content.
+	if old, err := ioutil.ReadFile(statPath); err == nil && bytes.Equal(old, b) {
+		return nil
+	}
 
 	// Store stat into temp file first and then rename.
 	// Ensures atomic update to stat file to avoid file damage.
@@ -297,24 +364,46 @@ func (ss *SiteStat) store(statPath string) (err error) {
 	if _, err = f.Write(b); err != nil {
 		errl.Println("Error writing stat file:", err)
 		f.Close()
+		os.Remove(f.Name())
+		return
+	}
+	// Close may report delayed write error, don't replace stat file then.
+	if err = f.Close(); err != nil {
+		errl.Println("Error closing stat file:", err)
+		os.Remove(f.Name())
 		return
 	}
-	f.Close()
 
 	// Windows don't allow rename to existing file.
 	os.Remove(statPath + ".bak")
 	os.Rename(statPath, statPath+".bak")
 	if err = os.Rename(f.Name(), statPath); err != nil {
 		errl.Println("rename new stat file", err)
+		os.Remove(f.Name())
+		// Restore the old stat file.
+		os.Rename(statPath+".bak", statPath)
 		return
 	}
 	return
 }
 
-func (ss *SiteStat) loadList(lst []string, direct, blocked vcntint) {
+// loadList adds user specified sites. Returns sites that are already
+// specified with the opposite direct/blocked setting, they are overridden.
+func (ss *SiteStat) loadList(lst []string, direct, blocked vcntint) (conflict []string) {
+	ss.vcLock.Lock()
 	for _, d := range lst {
+		// Empty key would match simple host and private IP which has no domain.
+		if d == "" {
+			continue
+		}
+		if vc, ok := ss.Vcnt[d]; ok && vc.userSpecified() &&
+			vc.AlwaysDirect() != (direct == userCnt) {
+			conflict = append(conflict, d)
+		}
 		ss.Vcnt[d] = newVisitCntWithTime(direct, blocked, zeroTime)
 	}
+	ss.vcLock.Unlock()
+	return
 }
 
 func (ss *SiteStat) loadBuiltinList() {
@@ -322,13 +411,74 @@ func (ss *SiteStat) loadBuiltinList() {
 	ss.loadList(directDomainList, userCnt, 0)
 }
 
-func (ss *SiteStat) loadUserList() {
-	if directList, err := loadSiteList(config.DirectFile); err == nil {
-		ss.loadList(directList, userCnt, 0)
+// loadUserList loads user specified direct and blocked list. Which list wins
+// if a site is in both is decided by config.DirectOnConflict. A list with
+// error is not loaded.
+func (ss *SiteStat) loadUserList() (conflict, override []string) {
+	var us userSites
+	for _, l := range []struct {
+		fpath  string
+		direct bool
+	}{{config.DirectFile, true}, {config.BlockedFile, false}} {
+		var lus userSites
+		if _, err := lus.loadSiteList(l.fpath, l.direct); err == nil {
+			us.direct = append(us.direct, lus.direct...)
+			us.blocked = append(us.blocked, lus.blocked...)
+		}
 	}
-	if blockedList, err := loadSiteList(config.BlockedFile); err == nil {
-		ss.loadList(blockedList, 0, userCnt)
+	return ss.loadUserSites(us.direct, us.blocked)
+}
+
+// loadUserSites returns sites in both direct and blocked list, and builtin
+// sites overridden by user.
+func (ss *SiteStat) loadUserSites(directList, blockedList []string) (conflict, override []string) {
+	// The list loaded later wins on conflict.
+	var first, overridden []string
+	if config.DirectOnConflict {
+		first = blockedList
+		override = ss.loadList(blockedList, 0, userCnt)
+		overridden = ss.loadList(directList, userCnt, 0)
+	} else {
+		first = directList
+		override = ss.loadList(directList, userCnt, 0)
+		overridden = ss.loadList(blockedList, 0, userCnt)
+	}
+	inFirst := make(map[string]bool, len(first))
+	for _, d := range first {
+		inFirst[d] = true
+	}
+	for _, d := range overridden {
+		if inFirst[d] {
+			conflict = append(conflict, d)
+		} else {
+			override = append(override, d)
+		}
 	}
+	return
+}
+
+const maxConflictReport = 10
+
+// reportListConflict logs sites specified as both direct and blocked in user
+// lists, the later loaded one wins.
+func (ss *SiteStat) reportListConflict(conflict []string) {
+	if len(conflict) == 0 {
+		return
+	}
+	var sample []string
+	for i, d := range conflict {
+		if i == maxConflictReport {
+			sample = append(sample, "...")
+			break
+		}
+		kind := "blocked"
+		if vc := ss.get(d); vc != nil && vc.AlwaysDirect() {
+			kind = "direct"
+		}
+		sample = append(sample, d+" (taken as "+kind+")")
+	}
+	errl.Printf("%d sites in both direct and blocked list: %s\n",
+		len(conflict), strings.Join(sample, ", "))
 }
 
 // Filter sites covered by user specified domains, also filter out stale
@@ -347,13 +497,13 @@ func (ss *SiteStat) filterSites() {
 			removeSites = append(removeSites, site)
 			continue
 		}
-		var dmcnt *VisitCnt
-		domain := host2Domain(site)
-		if domain != site {
-			dmcnt = ss.get(domain)
-		}
-		if dmcnt != nil && dmcnt.userSpecified() {
-			removeSites = append(removeSites, site)
+		// Any user specified parent domain covers the host. Already holding
+		// read lock, so don't use ss.get here.
+		for _, sfx := range hostSuffixes(site, host2Domain(site)) {
+			if dmcnt, ok := ss.Vcnt[sfx]; ok && dmcnt.userSpecified() {
+				removeSites = append(removeSites, site)
+				break
+			}
 		}
 	}
 	ss.vcLock.RUnlock()
@@ -366,17 +516,27 @@ func (ss *SiteStat) filterSites() {
 	ss.vcLock.Unlock()
 }
 
+// load decodes the stat file without locking, so it must be called before ss
+// is published. Loading site lists afterwards is safe while ss is in use.
 func (ss *SiteStat) load(file string) (err error) {
 	defer func() {
 		// load builtin list first, so user list can override builtin
 		ss.loadBuiltinList()
-		ss.loadUserList()
+		conflict, override := ss.loadUserList()
+		ss.reportListConflict(conflict)
+		if len(override) != 0 {
+			debug.Printf("%d builtin sites overridden by user list\n", len(override))
+		}
 		ss.filterSites()
+		ss.vcLock.RLock()
+		ss.hbhLock.Lock()
 		for host, vcnt := range ss.Vcnt {
 			if vcnt.OnceBlocked() {
 				ss.hasBlockedHost[host2Domain(host)] = true
 			}
 		}
+		ss.hbhLock.Unlock()
+		ss.vcLock.RUnlock()
 	}()
 	if file == "" {
 		return
@@ -409,6 +569,8 @@ func (ss *SiteStat) GetDirectList() []string {
 	lst := make([]string, 0)
 	// anyway to do more fine grained locking?
 	ss.vcLock.RLock()
+	// TempBlocked may update hasBlockedHost concurrently.
+	ss.hbhLock.RLock()
 	for site, vc := range ss.Vcnt {
 		if ss.hasBlockedHost[host2Domain(site)] {
 			continue
@@ -417,6 +579,7 @@ func (ss *SiteStat) GetDirectList() []string {
 			lst = append(lst, site)
 		}
 	}
+	ss.hbhLock.RUnlock()
 	ss.vcLock.RUnlock()
 	return lst
 }
@@ -424,6 +587,7 @@ func (ss *SiteStat) GetDirectList() []string {
 var siteStat = newSiteStat()
 
 func initSiteStat() {
+	tmpBlockedTimeout = config.TempBlockedTimeout
 	err := siteStat.load(config.StatFile)
 	if err != nil {
 		// Simply try to load the stat.back, create a new object to avoid error
@@ -470,34 +634,212 @@ func storeSiteStat(cont byte) {
 	}
 }
 
-func loadSiteList(fpath string) (lst []string, err error) {
+// userSites holds direct and blocked sites loaded from user lists.
+type userSites struct {
+	direct  []string
+	blocked []string
+}
+
+// loadSiteList reads one site per line from fpath. Lines starting with '#'
+// are comments, and anything after a '#' on a site line is ignored. COW never
+// writes back to the user's blocked/direct file, so comments are preserved.
+// Sites are converted to lower case as host names are case insensitive, and
+// trailing dot of fully qualified names are removed.
+// Wildcard like "*.example.com" is accepted and taken as "example.com".
+//
+// A line like "@include ads.txt" loads sites from another file, relative
+// paths are relative to the directory containing the including file. Files
+// already being loaded are not included again, so include loop is harmless.
+// Files with ".gz" suffix are decompressed with gzip.
+//
+// Sites prefixed with '+' are direct, and those prefixed with '-' are
+// blocked. Other sites are direct if direct is true. So a single file can
+// hold both direct and blocked sites.
+func (us *userSites) loadSiteList(fpath string, direct bool) (problem int, err error) {
+	return us.loadSiteListInclude(fpath, direct, map[string]bool{})
+}
+
+const siteListInclude = "@include"
+
+// loadSiteListInclude loads sites in fpath and its included files. Returns
+// the number of invalid sites skipped, includes failed to load and include
+// loops.
+func (us *userSites) loadSiteListInclude(fpath string, direct bool, loading map[string]bool) (problem int, err error) {
 	if fpath == "" {
 		return
 	}
+	fpath = path.Clean(fpath)
+	if loading[fpath] {
+		errl.Printf("domain list %s included recursively, ignored\n", fpath)
+		return 1, nil
+	}
+	loading[fpath] = true
+	defer delete(loading, fpath)
+
 	if err = isFileExists(fpath); err != nil {
 		if !os.IsNotExist(err) {
-			info.Printf("Error loading domaint list: %v\n", err)
+			errl.Printf("Error loading domain list %s: %v\n", fpath, err)
 		}
 		return
 	}
 	f, err := os.Open(fpath)
 	if err != nil {
-		errl.Println("Error opening domain list:", err)
+		errl.Printf("Error opening domain list %s: %v\n", fpath, err)
 		return
 	}
 	defer f.Close()
 
-	scanner := bufio.NewScanner(f)
-	lst = make([]string, 0)
+	var r io.Reader = f
+	if strings.HasSuffix(fpath, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			errl.Printf("Error opening gzip domain list %s: %v\n", fpath, err)
+			return problem, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	scanner := bufio.NewScanner(r)
+	var n, skipped int
 	for scanner.Scan() {
-		site := strings.TrimSpace(scanner.Text())
+		n++
+		site := scanner.Text()
+		if id := strings.IndexByte(site, '#'); id != -1 {
+			site = site[:id]
+		}
+		site = strings.TrimSpace(site)
+		if site == "" {
+			continue
+		}
+		if strings.HasPrefix(site, siteListInclude) {
+			inc := strings.TrimSpace(site[len(siteListInclude):])
+			if inc == "" {
+				errl.Printf("domain list %s line %d: missing include file\n", fpath, n)
+				problem++
+				continue
+			}
+			inc = expandTilde(inc)
+			if !path.IsAbs(inc) {
+				inc = path.Join(path.Dir(fpath), inc)
+			}
+			// Included list with error is not loaded, like a top level list.
+			var ius userSites
+			incProblem, err := ius.loadSiteListInclude(inc, direct, loading)
+			if err != nil {
+				// Other errors are already reported when loading inc.
+				if os.IsNotExist(err) {
+					errl.Printf("domain list %s line %d: include file %s not exist\n", fpath, n, inc)
+				}
+				problem++
+			} else {
+				us.direct = append(us.direct, ius.direct...)
+				us.blocked = append(us.blocked, ius.blocked...)
+			}
+			problem += incProblem
+			continue
+		}
+		siteDirect := direct
+		if site[0] == '+' || site[0] == '-' {
+			siteDirect = site[0] == '+'
+			site = strings.TrimSpace(site[1:])
+		}
+		// User specified site already covers all its sub hosts.
+		site = strings.ToLower(trimLastDot(strings.TrimPrefix(site, "*.")))
+		site = normalizeSite(site)
 		if site == "" {
 			continue
 		}
-		lst = append(lst, site)
+		if !isValidSite(site) {
+			errl.Printf("domain list %s line %d: invalid site \"%s\", skipped\n", fpath, n, site)
+			skipped++
+			continue
+		}
+		if siteDirect {
+			us.direct = append(us.direct, site)
+		} else {
+			us.blocked = append(us.blocked, site)
+		}
+	}
+	if skipped > 0 {
+		info.Printf("%d invalid sites skipped in domain list %s\n", skipped, fpath)
 	}
 	if scanner.Err() != nil {
 		errl.Printf("Error reading domain list %s: %v\n", fpath, scanner.Err())
 	}
-	return lst, scanner.Err()
+	return problem + skipped, scanner.Err()
+}
+
+// normalizeSite applies transforms selected by config.ListNormalize to a
+// site in user list.
+func normalizeSite(site string) string {
+	if config.ListNormalize&listNormalizeWWW != 0 {
+		site = strings.TrimPrefix(site, "www.")
+	}
+	if config.ListNormalize&listNormalizeDomain != 0 {
+		if dm := host2Domain(site); dm != "" {
+			site = dm
+		}
+	}
+	return site
+}
+
+// isSuffixOnlySite checks whether a site is something like "co.uk". Parent
+// domains are only checked down to domain like "bbc.co.uk", so such site
+// never covers other hosts.
+func isSuffixOnlySite(site string) bool {
+	if isIP, _ := hostIsIP(site); isIP {
+		return false
+	}
+	dot := strings.IndexByte(site, '.')
+	if dot == -1 {
+		return false
+	}
+	return !strings.Contains(site[dot+1:], ".") && topLevelDomain[site[:dot]]
+}
+
+// checkSiteLists loads builtin and user specified site lists and reports
+// problems found in user lists. Returns the number of problems.
+func checkSiteLists() (problem int) {
+	var us userSites
+	load := func(fpath string, direct bool) {
+		invalid, err := us.loadSiteList(fpath, direct)
+		if err != nil && !os.IsNotExist(err) {
+			problem++
+		}
+		problem += invalid
+	}
+	load(config.DirectFile, true)
+	load(config.BlockedFile, false)
+	directList, blockedList := us.direct, us.blocked
+	for _, site := range append(directList, blockedList...) {
+		if isIP, _ := hostIsIP(site); !isIP && !strings.Contains(site, ".") {
+			errl.Printf("site \"%s\" in domain list is a simple host, which is always accessed directly\n", site)
+			problem++
+		} else if isSuffixOnlySite(site) {
+			errl.Printf("site \"%s\" in domain list is only a domain suffix, it covers no other host\n", site)
+			problem++
+		}
+	}
+
+	// Conflict between user lists is a problem, overriding builtin list is
+	// considered intended.
+	ss := newSiteStat()
+	ss.loadBuiltinList()
+	conflict, override := ss.loadUserSites(directList, blockedList)
+	ss.reportListConflict(conflict)
+	problem += len(conflict)
+
+	fmt.Printf("%d direct sites, %d blocked sites\n", len(directList), len(blockedList))
+	if len(override) != 0 {
+		fmt.Printf("%d builtin sites overridden: %s\n", len(override), strings.Join(override, ", "))
+	}
+	fmt.Printf("%d problems found\n", problem)
+	return
+}
+
+// isValidSite checks whether a site in domain list is a bare host or domain.
+// URLs like http://example.com/path and host:port are not allowed.
+func isValidSite(site string) bool {
+	return !strings.ContainsAny(site, "/: \t*")
 }
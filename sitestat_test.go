@@ -1,13 +1,44 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
 	"time"
 )
 
 var _ = os.Remove
 
+// setTestParentProxy sets a socks parent proxy, as GetVisitCnt always returns
+// direct without parent proxy. Call the returned function to restore.
+func setTestParentProxy() (restore func()) {
+	pp := parentProxy
+	parentProxy = &backupParentPool{}
+	parentProxy.add(newSocksParent("127.0.0.1:1080"))
+	return func() { parentProxy = pp }
+}
+
+// setTestUserLists sets user direct and blocked list file. Call the returned
+// function to restore.
+func setTestUserLists(direct, blocked string) (restore func()) {
+	oldDirect, oldBlocked := config.DirectFile, config.BlockedFile
+	config.DirectFile, config.BlockedFile = direct, blocked
+	return func() { config.DirectFile, config.BlockedFile = oldDirect, oldBlocked }
+}
+
+// writeTestFile writes content to fpath. Call the returned function to remove
+// the file.
+func writeTestFile(t *testing.T, fpath, content string) (remove func()) {
+	if err := ioutil.WriteFile(fpath, []byte(content), 0644); err != nil {
+		t.Fatal("write test file:", err)
+	}
+	return func() { os.Remove(fpath) }
+}
+
 func TestNetworkBad(t *testing.T) {
 	if networkBad() {
 		t.Error("Network by default should be good")
@@ -261,3 +292,576 @@ func TestSiteStatGetVisitCnt(t *testing.T) {
 		t.Errorf("%s has one blocked visit, should has once blocked\n", g1.Host)
 	}
 }
+
+func TestLoadSiteList(t *testing.T) {
+	const lstfile = "testdata/sitelist"
+	content := "# comment line\n" +
+		"foo.com\n" +
+		"\n" +
+		"bar.com # inline comment\n" +
+		"Mixed.Example.COM\n" +
+		"crlf.com\r\n" +
+		"*.wildcard.com\n" +
+		"a*.wildcard.com\n" +
+		"http://example.com/path\n" +
+		"example.com:8080\n" +
+		"foo bar.com\n" +
+		"   #indented comment\n" +
+		" \t \n" +
+		"*.\n" +
+		"fqdn.com.\n" +
+		".\n"
+	defer writeTestFile(t, lstfile, content)()
+
+	var us userSites
+	_, err := us.loadSiteList(lstfile, true)
+	lst := us.direct
+	if err != nil {
+		t.Fatal("load site list error:", err)
+	}
+	expected := []string{"foo.com", "bar.com", "mixed.example.com", "crlf.com", "wildcard.com", "fqdn.com"}
+	if len(lst) != len(expected) {
+		t.Fatalf("site list should have %d sites, got: %v\n", len(expected), lst)
+	}
+	for i, site := range expected {
+		if lst[i] != site {
+			t.Errorf("site %d should be %s, got: %s\n", i, site, lst[i])
+		}
+	}
+}
+
+func TestSiteStatLoadEmptySite(t *testing.T) {
+	ss := newSiteStat()
+	ss.loadList([]string{""}, userCnt, 0)
+	if ss.get("") != nil {
+		t.Error("empty site should not be loaded")
+	}
+}
+
+func TestLoadSiteListInclude(t *testing.T) {
+	const (
+		mainfile = "testdata/sitelist-main"
+		incfile  = "testdata/sitelist-inc"
+	)
+	files := map[string]string{
+		mainfile: "main.com\n@include sitelist-inc\n@include nosuchfile\n",
+		// include loop should be ignored
+		incfile: "inc.com\n@include sitelist-main\n",
+	}
+	for fpath, content := range files {
+		defer writeTestFile(t, fpath, content)()
+	}
+
+	var us userSites
+	_, err := us.loadSiteList(mainfile, true)
+	lst := us.direct
+	if err != nil {
+		t.Fatal("load site list error:", err)
+	}
+	expected := []string{"main.com", "inc.com"}
+	if len(lst) != len(expected) {
+		t.Fatalf("site list should have %d sites, got: %v\n", len(expected), lst)
+	}
+	for i, site := range expected {
+		if lst[i] != site {
+			t.Errorf("site %d should be %s, got: %s\n", i, site, lst[i])
+		}
+	}
+}
+
+func TestLoadSiteListMarker(t *testing.T) {
+	const (
+		mainfile = "testdata/sitelist-marker"
+		incfile  = "testdata/sitelist-marker-inc"
+	)
+	files := map[string]string{
+		mainfile: "+direct.com\n- blocked.com\nplain.com\n@include sitelist-marker-inc\n+\n",
+		incfile:  "+incdirect.com\nincplain.com\n",
+	}
+	for fpath, content := range files {
+		defer writeTestFile(t, fpath, content)()
+	}
+
+	var us userSites
+	if _, err := us.loadSiteList(mainfile, false); err != nil {
+		t.Fatal("load site list error:", err)
+	}
+	expected := userSites{
+		direct:  []string{"direct.com", "incdirect.com"},
+		blocked: []string{"blocked.com", "plain.com", "incplain.com"},
+	}
+	if fmt.Sprint(us.direct) != fmt.Sprint(expected.direct) {
+		t.Errorf("direct sites should be %v, got: %v\n", expected.direct, us.direct)
+	}
+	if fmt.Sprint(us.blocked) != fmt.Sprint(expected.blocked) {
+		t.Errorf("blocked sites should be %v, got: %v\n", expected.blocked, us.blocked)
+	}
+}
+
+func TestLoadSiteListGzip(t *testing.T) {
+	const (
+		gzfile   = "testdata/sitelist.gz"
+		plainInc = "testdata/sitelist-plain"
+	)
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte("# gzipped list\nGz.com\n@include sitelist-plain\n"))
+	gz.Close()
+	defer writeTestFile(t, gzfile, buf.String())()
+	defer writeTestFile(t, plainInc, "plain.com\n")()
+
+	var us userSites
+	_, err := us.loadSiteList(gzfile, true)
+	lst := us.direct
+	if err != nil {
+		t.Fatal("load gzip site list error:", err)
+	}
+	if len(lst) != 2 || lst[0] != "gz.com" || lst[1] != "plain.com" {
+		t.Error("gzip site list not loaded correctly, got:", lst)
+	}
+
+	// Not in gzip format.
+	writeTestFile(t, gzfile, "gz.com\n")
+	if _, err := new(userSites).loadSiteList(gzfile, true); err == nil {
+		t.Error("loading non gzip file with .gz suffix should fail")
+	}
+}
+
+func TestSiteStatConcurrentUpdate(t *testing.T) {
+	ss := newSiteStat()
+	const stfile = "testdata/stat-concurrent"
+	defer os.Remove(stfile)
+	defer os.Remove(stfile + ".bak")
+
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 1000; i++ {
+			url, _ := ParseRequestURI(fmt.Sprintf("www.concurrent%d.com", i))
+			ss.create(url.Host)
+			ss.TempBlocked(url)
+		}
+		close(done)
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		ss.GetDirectList()
+		if err := ss.store(stfile); err != nil {
+			t.Fatal("store error:", err)
+		}
+		// force storing all records
+		ss.Update = Date(time.Now().Add(-2 * siteStaleThreshold))
+	}
+}
+
+func TestSiteStatConcurrentLoadList(t *testing.T) {
+	ss := newSiteStat()
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 1000; i++ {
+			ss.loadBuiltinList()
+			ss.filterSites()
+		}
+		close(done)
+	}()
+	// Writer waiting for the lock should not block filterSites.
+	created := make(chan bool)
+	go func() {
+		defer close(created)
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			ss.create(fmt.Sprintf("www%d.twitter.com", i))
+		}
+	}()
+	tw, _ := ParseRequestURI("twitter.com")
+	for {
+		select {
+		case <-done:
+			<-created
+			return
+		default:
+		}
+		ss.get(tw.Host)
+		ss.GetDirectList()
+	}
+}
+
+func TestHostSuffixes(t *testing.T) {
+	defer setTestParentProxy()()
+
+	var testData = []struct {
+		host   string
+		domain string
+		sfx    []string
+	}{
+		{"google.com", "google.com", nil},
+		{"www.google.com", "google.com", []string{"google.com"}},
+		{"a.b.plus.google.com", "google.com", []string{"b.plus.google.com", "plus.google.com", "google.com"}},
+		{"a.b.co.uk", "b.co.uk", []string{"b.co.uk"}},
+		{"www.google.com.hk", "google.com.hk", []string{"google.com.hk"}},
+		{"simplehost", "", nil},
+	}
+	for _, td := range testData {
+		sfx := hostSuffixes(td.host, td.domain)
+		if len(sfx) != len(td.sfx) {
+			t.Errorf("%s suffixes should be %v, got: %v\n", td.host, td.sfx, sfx)
+			continue
+		}
+		for i, s := range td.sfx {
+			if sfx[i] != s {
+				t.Errorf("%s suffixes should be %v, got: %v\n", td.host, td.sfx, sfx)
+				break
+			}
+		}
+	}
+
+	ss := newSiteStat()
+	ss.loadList([]string{"cdn.stemp.com"}, 0, userCnt)
+	u, _ := ParseRequestURI("img.cdn.stemp.com")
+	if vc := ss.GetVisitCnt(u); !vc.AlwaysBlocked() {
+		t.Errorf("%s should be covered by user specified cdn.stemp.com\n", u.Host)
+	}
+	u, _ = ParseRequestURI("www.stemp.com")
+	if vc := ss.GetVisitCnt(u); vc.userSpecified() {
+		t.Errorf("%s should not be covered by user specified cdn.stemp.com\n", u.Host)
+	}
+}
+
+func TestSiteStatLookupLongHost(t *testing.T) {
+	defer setTestParentProxy()()
+
+	ss := newSiteStat()
+	ss.loadList([]string{"cdn.stemp.com", "ltemp.com"}, 0, userCnt)
+	long, _ := ParseRequestURI(strings.Repeat("a.", 200) + "cdn.stemp.com")
+	if vc := ss.GetVisitCnt(long); vc.userSpecified() {
+		t.Error("intermediate parent domains of too long host should not be checked")
+	}
+	long, _ = ParseRequestURI(strings.Repeat("a.", 200) + "ltemp.com")
+	if vc := ss.GetVisitCnt(long); !vc.AlwaysBlocked() {
+		t.Error("domain of too long host should still be checked")
+	}
+}
+
+func TestSiteStatListConflict(t *testing.T) {
+	const (
+		directFile  = "testdata/direct-conflict"
+		blockedFile = "testdata/blocked-conflict"
+	)
+	defer writeTestFile(t, directFile, "both.com\ndirect.com\n")()
+	defer writeTestFile(t, blockedFile, "both.com\nblocked.com\n")()
+
+	defer setTestUserLists(directFile, blockedFile)()
+	defer func(c bool) { config.DirectOnConflict = c }(config.DirectOnConflict)
+
+	config.DirectOnConflict = false
+	ss := newSiteStat()
+	conflict, _ := ss.loadUserList()
+	if len(conflict) != 1 || conflict[0] != "both.com" {
+		t.Error("both.com should be reported as conflict, got:", conflict)
+	}
+	if vc := ss.get("both.com"); vc == nil || !vc.AlwaysBlocked() {
+		t.Error("both.com should be blocked by default on conflict")
+	}
+
+	config.DirectOnConflict = true
+	ss = newSiteStat()
+	ss.loadUserList()
+	if vc := ss.get("both.com"); vc == nil || !vc.AlwaysDirect() {
+		t.Error("both.com should be direct when direct wins on conflict")
+	}
+	if vc := ss.get("blocked.com"); vc == nil || !vc.AlwaysBlocked() {
+		t.Error("blocked.com should be blocked")
+	}
+	if vc := ss.get("direct.com"); vc == nil || !vc.AlwaysDirect() {
+		t.Error("direct.com should be direct")
+	}
+
+	// user list overriding builtin list is intended, not a conflict
+	ss = newSiteStat()
+	ss.loadBuiltinList()
+	conflict, override := ss.loadUserSites([]string{"twitter.com", "apple.com", "newsite.com"}, nil)
+	if len(conflict) != 0 {
+		t.Error("overriding builtin site should not be reported as conflict, got:", conflict)
+	}
+	if len(override) != 1 || override[0] != "twitter.com" {
+		t.Error("only twitter.com should be reported as overridden, got:", override)
+	}
+	ss = newSiteStat()
+	ss.loadBuiltinList()
+	conflict, override = ss.loadUserSites([]string{"direct.com"}, []string{"apple.com", "direct.com"})
+	if len(conflict) != 1 || conflict[0] != "direct.com" {
+		t.Error("direct.com should be reported as conflict, got:", conflict)
+	}
+	if len(override) != 1 || override[0] != "apple.com" {
+		t.Error("only apple.com should be reported as overridden, got:", override)
+	}
+}
+
+func TestSiteStatLoadUserListError(t *testing.T) {
+	const blockedFile = "testdata/blocked-error"
+	// Line too long for scanner, reading fails after partial.com.
+	content := "partial.com\n" + strings.Repeat("a", 70000) + "\n"
+	defer writeTestFile(t, blockedFile, content)()
+
+	defer setTestUserLists("", blockedFile)()
+
+	ss := newSiteStat()
+	ss.loadUserList()
+	if ss.get("partial.com") != nil {
+		t.Error("list with read error should not be loaded")
+	}
+
+	// Included list with read error is not loaded, the including list is.
+	const includeFile = "testdata/blocked-include-error"
+	defer writeTestFile(t, includeFile, "good.com\n@include blocked-error\n")()
+	defer setTestUserLists("", includeFile)()
+
+	ss = newSiteStat()
+	ss.loadUserList()
+	if ss.get("partial.com") != nil {
+		t.Error("included list with read error should not be loaded")
+	}
+	if ss.get("good.com") == nil {
+		t.Error("site in including list should be loaded")
+	}
+}
+
+func TestSiteStatGetVisitCntPrecedence(t *testing.T) {
+	defer setTestParentProxy()()
+
+	ss := newSiteStat()
+	ss.loadList([]string{"dprec.com", "d.bprec.com", "8.8.4.4"}, userCnt, 0)
+	// Simple host and private ip bypass lists.
+	ss.loadList([]string{"bprec.com", "b.dprec.com", "8.8.8.8", "localhost", "10.0.0.1"}, 0, userCnt)
+	ss.filterSites()
+
+	const (
+		direct = iota
+		blocked
+		learned
+	)
+	var testData = []struct {
+		rawurl string
+		expect int
+	}{
+		{"dprec.com", direct},
+		{"www.dprec.com", direct},
+		{"b.dprec.com", blocked},   // host takes precedence over domain
+		{"x.b.dprec.com", blocked}, // nearest parent domain wins
+		{"dprec.com.", direct},     // fully qualified host
+		{"x.b.dprec.com.", blocked},
+		{"bprec.com", blocked},
+		{"d.bprec.com", direct},
+		{"8.8.8.8", blocked},
+		{"8.8.4.4:443", direct},
+		{"192.168.1.1", direct}, // private ip has no domain
+		{"simplehost", direct},  // simple host has no domain
+		{"localhost", direct},
+		{"127.0.0.1:8080", direct},
+		{"10.0.0.1", direct},
+		{"172.16.0.1", direct},
+		{"www.unknownprec.com", learned},
+	}
+	for _, td := range testData {
+		url, _ := ParseRequestURI(td.rawurl)
+		vc := ss.GetVisitCnt(url)
+		switch td.expect {
+		case direct:
+			if !vc.AlwaysDirect() || vc.AlwaysBlocked() {
+				t.Errorf("%s should always direct\n", td.rawurl)
+			}
+		case blocked:
+			if !vc.AlwaysBlocked() || vc.AlwaysDirect() {
+				t.Errorf("%s should always blocked\n", td.rawurl)
+			}
+		case learned:
+			if vc.userSpecified() {
+				t.Errorf("%s should not be user specified\n", td.rawurl)
+			}
+		}
+	}
+
+	// Temp blocked host should use parent proxy, but only for that host.
+	url, _ := ParseRequestURI("www.unknownprec.com")
+	ss.TempBlocked(url)
+	if !ss.GetVisitCnt(url).AsBlocked() {
+		t.Errorf("%s should be blocked after temp blocked\n", url.Host)
+	}
+	other, _ := ParseRequestURI("img.unknownprec.com")
+	if ss.GetVisitCnt(other).AsTempBlocked() {
+		t.Errorf("%s should not be temp blocked\n", other.Host)
+	}
+	fqdn, _ := ParseRequestURI("www.unknownprec.com.")
+	if !ss.GetVisitCnt(fqdn).AsTempBlocked() {
+		t.Errorf("%s should share temp blocked state with %s\n", fqdn.Host, url.Host)
+	}
+}
+
+func BenchmarkSiteStatGetVisitCnt(b *testing.B) {
+	defer setTestParentProxy()()
+
+	ss := newSiteStat()
+	ss.loadBuiltinList()
+	url, _ := ParseRequestURI("a.b.plus.google.com")
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			ss.GetVisitCnt(url)
+		}
+	})
+}
+
+func TestCheckSiteLists(t *testing.T) {
+	const (
+		directFile  = "testdata/direct-check"
+		blockedFile = "testdata/blocked-check"
+		badGzFile   = "testdata/check-bad.gz"
+	)
+	defer writeTestFile(t, directFile, "ok.com\nboth.com\ncom\nlocalhost\n")()
+	blocked := "both.com\nco.uk\nhttp://bad.com/\n@include check-nosuchfile\n@include check-bad.gz\n" +
+		"@include blocked-check\n"
+	defer writeTestFile(t, blockedFile, blocked)()
+	defer writeTestFile(t, badGzFile, "not gzip\n")()
+
+	defer setTestUserLists(directFile, blockedFile)()
+
+	// com, localhost, co.uk, invalid url, conflicting both.com, missing
+	// include, corrupt gzip include and include loop
+	if n := checkSiteLists(); n != 8 {
+		t.Errorf("checkSiteLists should find 8 problems, got %d\n", n)
+	}
+
+	writeTestFile(t, blockedFile, "blocked.com\nbbc.co.uk\n")
+	writeTestFile(t, directFile, "ok.com\n127.0.0.1\n")
+	if n := checkSiteLists(); n != 0 {
+		t.Errorf("checkSiteLists should find no problem, got %d\n", n)
+	}
+}
+
+func TestSiteStatStoreContent(t *testing.T) {
+	ss := newSiteStat()
+	ss.Vcnt["b.com"] = newVisitCnt(0, 2)
+	ss.Vcnt["a.com"] = newVisitCnt(3, 0)
+	ss.Vcnt["empty.com"] = newVisitCnt(0, 0)
+
+	const stfile = "testdata/stat-content"
+	if err := ss.store(stfile); err != nil {
+		t.Fatal("store error:", err)
+	}
+	defer os.Remove(stfile)
+	b, err := ioutil.ReadFile(stfile)
+	if err != nil {
+		t.Fatal("read stat file:", err)
+	}
+	today := time.Now().Format(dateLayout)
+	expected := fmt.Sprintf(`{
+	"update": "%[1]s",
+	"site_info": {
+		"a.com": {
+			"direct": 3,
+			"block": 0,
+			"recent": "%[1]s"
+		},
+		"b.com": {
+			"direct": 0,
+			"block": 2,
+			"recent": "%[1]s"
+		}
+	}
+}
+`, today)
+	if string(b) != expected {
+		t.Errorf("stat file content wrong, got:\n%s\nexpected:\n%s\n", b, expected)
+	}
+
+	// Storing unchanged content should not touch the file.
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(stfile, old, old); err != nil {
+		t.Fatal("change stat file time:", err)
+	}
+	if err := ss.store(stfile); err != nil {
+		t.Fatal("store error:", err)
+	}
+	if fi, err := os.Stat(stfile); err != nil || !fi.ModTime().Equal(old) {
+		t.Error("stat file should not be rewritten if content is unchanged")
+	}
+	if err := isFileExists(stfile + ".bak"); err == nil {
+		t.Error("stat file should not be backed up if content is unchanged")
+	}
+
+	ss.Vcnt["a.com"].Direct++
+	if err := ss.store(stfile); err != nil {
+		t.Fatal("store error:", err)
+	}
+	defer os.Remove(stfile + ".bak")
+	if fi, err := os.Stat(stfile); err != nil || fi.ModTime().Equal(old) {
+		t.Error("stat file should be rewritten if content changed")
+	}
+}
+
+func TestNormalizeSite(t *testing.T) {
+	defer func(n ListNormalize) { config.ListNormalize = n }(config.ListNormalize)
+
+	testData := []struct {
+		normalize ListNormalize
+		site      string
+		expected  string
+	}{
+		{0, "www.example.com", "www.example.com"},
+		{listNormalizeWWW, "www.example.com", "example.com"},
+		{listNormalizeWWW, "www2.example.com", "www2.example.com"},
+		{listNormalizeWWW | listNormalizeDomain, "www.plus.google.com", "google.com"},
+		{listNormalizeDomain, "plus.google.com", "google.com"},
+		{listNormalizeDomain, "www.bbc.co.uk", "bbc.co.uk"},
+		{listNormalizeDomain, "localhost", "localhost"},
+		{listNormalizeDomain, "10.1.2.3", "10.1.2.3"},
+	}
+	for _, td := range testData {
+		config.ListNormalize = td.normalize
+		if site := normalizeSite(td.site); site != td.expected {
+			t.Errorf("normalize %d %s got %s, should be %s\n",
+				td.normalize, td.site, site, td.expected)
+		}
+	}
+}
+
+func TestSiteStatFilterCoveredHost(t *testing.T) {
+	defer setTestParentProxy()()
+
+	const (
+		stfile      = "testdata/stat-filter"
+		blockedFile = "testdata/blocked-filter"
+	)
+	ss := newSiteStat()
+	ss.Vcnt["img.cdn.filter.com"] = newVisitCnt(10, 0)
+	ss.Vcnt["www.filter.com"] = newVisitCnt(10, 0)
+	if err := ss.store(stfile); err != nil {
+		t.Fatal("store error:", err)
+	}
+	defer os.Remove(stfile)
+
+	defer writeTestFile(t, blockedFile, "cdn.filter.com\n")()
+	defer setTestUserLists("", blockedFile)()
+
+	ld := newSiteStat()
+	if err := ld.load(stfile); err != nil {
+		t.Fatal("load stat error:", err)
+	}
+	if ld.get("img.cdn.filter.com") != nil {
+		t.Error("host covered by user specified cdn.filter.com should be filtered")
+	}
+	if ld.get("www.filter.com") == nil {
+		t.Error("www.filter.com is not covered by cdn.filter.com, should be kept")
+	}
+	u, _ := ParseRequestURI("img.cdn.filter.com")
+	if vc := ld.GetVisitCnt(u); !vc.AlwaysBlocked() {
+		t.Errorf("%s should use user specified blocked setting\n", u.Host)
+	}
+}